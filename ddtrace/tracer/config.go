@@ -0,0 +1,57 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import "time"
+
+// config holds the tracer configuration, populated by the StartOptions
+// passed to Start.
+type config struct {
+	// serviceName specifies the name given to this application.
+	serviceName string
+
+	// samplingRules contains user-defined rules for the rules sampler, set
+	// via WithSamplingRules.
+	samplingRules []SamplingRule
+
+	// samplingPolicy, set via WithSamplingPolicy, is consulted before the
+	// rules/priority sampler chain when a span is started.
+	samplingPolicy SamplingPolicy
+
+	// remoteSamplingURL and remoteSamplingRefresh configure remote adaptive
+	// sampling, set via WithRemoteSampling. remoteSamplingURL is empty when
+	// remote sampling is disabled, which is the default.
+	remoteSamplingURL     string
+	remoteSamplingRefresh time.Duration
+}
+
+// newConfig creates a config populated using the given set of StartOptions.
+func newConfig(opts ...StartOption) *config {
+	c := new(config)
+	for _, fn := range opts {
+		fn(c)
+	}
+	return c
+}
+
+// StartOption represents a function that can be provided as a parameter to Start.
+type StartOption func(*config)
+
+// WithServiceName sets the given service name for this application.
+func WithServiceName(name string) StartOption {
+	return func(c *config) {
+		c.serviceName = name
+	}
+}
+
+// WithSamplingRules specifies the sampling rates to apply to spans based on the
+// sampling rules provided. When DD_TRACE_SAMPLING_RULES is set, these rules are
+// ignored in favor of the env-provided ones.
+func WithSamplingRules(rules []SamplingRule) StartOption {
+	return func(c *config) {
+		c.samplingRules = rules
+	}
+}
@@ -0,0 +1,101 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import (
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+)
+
+// SamplingParameters holds the information a SamplingPolicy needs in order to
+// make a sampling decision for a span being started.
+type SamplingParameters struct {
+	// Span is the span being started.
+	Span ddtrace.Span
+
+	// Service is the span's service name.
+	Service string
+
+	// Operation is the span's operation name.
+	Operation string
+
+	// Resource is the span's resource name.
+	Resource string
+
+	// ParentPriority is the sampling priority extracted from the parent
+	// context, if any. It is only meaningful when HasParent is true.
+	ParentPriority int
+
+	// HasParent reports whether an inbound trace context (e.g. a distributed
+	// tracing header) was present when the span was started.
+	HasParent bool
+}
+
+// SamplingDecision is the result of a SamplingPolicy evaluating a
+// SamplingParameters.
+type SamplingDecision struct {
+	// Keep reports whether the span should be kept (sampled in).
+	Keep bool
+
+	// Priority is the sampling priority to assign to the span, one of the
+	// ext.Priority* constants.
+	Priority int
+
+	// Rate is the sampling rate that led to this decision, recorded for
+	// analytics purposes.
+	Rate float64
+
+	// PolicyName identifies the policy that made the decision.
+	PolicyName string
+}
+
+// SamplingPolicy is a pluggable, higher-level alternative to Sampler. Unlike
+// Sampler, which only sees the span, a SamplingPolicy receives the full
+// SamplingParameters for the span being started and returns a rich
+// SamplingDecision, letting it take the parent's sampling priority and
+// distributed tracing context into account.
+//
+// A SamplingPolicy set via WithSamplingPolicy is consulted before the
+// rules/priority sampler chain; the chain only runs if the policy did not
+// make a decision for a given span.
+type SamplingPolicy interface {
+	// Evaluate returns the sampling decision for the given parameters, and
+	// reports whether the policy applies to this span at all. When applies
+	// is false, the decision is ignored and the regular rules/priority
+	// sampler chain is consulted instead.
+	Evaluate(params SamplingParameters) (decision SamplingDecision, applies bool)
+}
+
+// applySamplingPolicy consults the configured SamplingPolicy, if any, for the
+// given span. It reports whether the policy made a decision, in which case
+// the span has already been tagged accordingly.
+func applySamplingPolicy(policy SamplingPolicy, spn *span, params SamplingParameters) bool {
+	if policy == nil {
+		return false
+	}
+	decision, applies := policy.Evaluate(params)
+	if !applies {
+		return false
+	}
+	spn.SetTag("_dd.sampling_policy", decision.PolicyName)
+	spn.SetTag("_dd.sampling_weight", decision.Rate)
+	if decision.Keep {
+		spn.SetTag(ext.SamplingPriority, decision.Priority)
+	} else {
+		spn.SetTag(ext.SamplingPriority, ext.PriorityAutoReject)
+	}
+	return true
+}
+
+// WithSamplingPolicy sets the SamplingPolicy to consult before the rules and
+// priority samplers when starting a span. This allows composing custom
+// sampling logic, such as "always sample if a parent trace context was
+// present, otherwise sample at 1%", without forking the tracer.
+func WithSamplingPolicy(p SamplingPolicy) StartOption {
+	return func(c *config) {
+		c.samplingPolicy = p
+	}
+}
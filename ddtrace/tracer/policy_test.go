@@ -0,0 +1,75 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import (
+	"testing"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// alwaysKeepPolicy is a SamplingPolicy test double that always applies and
+// keeps the span, recording the SamplingParameters it was called with.
+type alwaysKeepPolicy struct {
+	called SamplingParameters
+}
+
+func (p *alwaysKeepPolicy) Evaluate(params SamplingParameters) (SamplingDecision, bool) {
+	p.called = params
+	return SamplingDecision{Keep: true, Priority: ext.PriorityUserKeep, Rate: 1, PolicyName: "always-keep"}, true
+}
+
+func TestApplySamplingPolicyKeep(t *testing.T) {
+	assert := assert.New(t)
+	p := &alwaysKeepPolicy{}
+	s := &span{Service: "svc", Name: "op", Meta: map[string]string{}, Metrics: map[string]float64{}}
+
+	applied := applySamplingPolicy(p, s, SamplingParameters{Service: "svc", Operation: "op"})
+
+	assert.True(applied)
+	assert.Equal("always-keep", s.Meta["_dd.sampling_policy"])
+	assert.Equal(float64(1), s.Metrics["_dd.sampling_weight"])
+	assert.Equal(float64(ext.PriorityUserKeep), s.Metrics[ext.SamplingPriority])
+	assert.Equal("svc", p.called.Service)
+}
+
+func TestApplySamplingPolicyNil(t *testing.T) {
+	assert := assert.New(t)
+	s := &span{Meta: map[string]string{}, Metrics: map[string]float64{}}
+	assert.False(applySamplingPolicy(nil, s, SamplingParameters{}))
+}
+
+func TestTracerConsultsSamplingPolicyBeforeRules(t *testing.T) {
+	assert := assert.New(t)
+	p := &alwaysKeepPolicy{}
+	tr := newTracer(WithSamplingPolicy(p), WithSamplingRules([]SamplingRule{RateRule(0)}))
+	defer tr.Stop()
+
+	s := tr.StartSpan("my-op")
+
+	assert.Equal(float64(ext.PriorityUserKeep), s.Metrics[ext.SamplingPriority])
+	assert.Equal("my-op", p.called.Operation)
+}
+
+// TestFinishDoesNotOverridePolicyDecision guards against a tag-based rule
+// silently overriding a SamplingPolicy's decision at Finish: the policy is
+// meant to be consulted instead of the rules chain, not just first.
+func TestFinishDoesNotOverridePolicyDecision(t *testing.T) {
+	assert := assert.New(t)
+	p := &alwaysKeepPolicy{}
+	rules := []SamplingRule{TagRule(map[string]string{"http.status_code": "5.."}, 0)}
+	tr := newTracer(WithSamplingPolicy(p), WithSamplingRules(rules))
+	defer tr.Stop()
+
+	s := tr.StartSpan("my-op")
+	s.SetTag("http.status_code", "503") // would match the tag rule, at rate 0
+
+	s.Finish()
+
+	assert.Equal(float64(ext.PriorityUserKeep), s.Metrics[ext.SamplingPriority], "the policy's decision must stand")
+}
@@ -0,0 +1,262 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
+
+	"golang.org/x/time/rate"
+)
+
+// remoteSamplingMinInterval is the lowest refresh interval accepted for remote
+// sampling polling. Lower values are rejected in favor of this default, to
+// avoid hammering the agent.
+const remoteSamplingMinInterval = 5 * time.Second
+
+// operationKey identifies a (service, operation) pair that a remote sampling
+// strategy applies to.
+type operationKey struct {
+	service   string
+	operation string
+}
+
+// guaranteedThroughputSampler samples spans using a probabilistic rate, but
+// guarantees a minimum number of traces per second get sampled regardless of
+// the probabilistic outcome, using a token-bucket rate limiter. This mirrors
+// the "adaptive sampler" strategy used by Jaeger.
+type guaranteedThroughputSampler struct {
+	rate    float64
+	limiter *rate.Limiter
+}
+
+// newGuaranteedThroughputSampler returns a sampler that samples at the given
+// rate, while also allowing at least lowerBound traces per second through.
+func newGuaranteedThroughputSampler(rate, lowerBound float64) *guaranteedThroughputSampler {
+	return &guaranteedThroughputSampler{
+		rate:    rate,
+		limiter: newThroughputLimiter(lowerBound),
+	}
+}
+
+// newThroughputLimiter returns a rate.Limiter configured to allow at least
+// tracesPerSecond traces per second, with a burst of 1 so a single trace can
+// always get through once a token is available.
+func newThroughputLimiter(tracesPerSecond float64) *rate.Limiter {
+	if tracesPerSecond <= 0 {
+		return rate.NewLimiter(0, 0)
+	}
+	return rate.NewLimiter(rate.Limit(tracesPerSecond), 1)
+}
+
+// sample reports whether the span identified by traceID should be sampled,
+// either because the probabilistic rate check passed, or because the
+// guaranteed-throughput bucket still has a token available.
+func (s *guaranteedThroughputSampler) sample(traceID uint64) bool {
+	if sampledByRate(traceID, s.rate) {
+		// still consume a token, so traces sampled probabilistically count
+		// toward the lower bound and the bucket only adds traces beyond them.
+		s.limiter.Allow()
+		return true
+	}
+	return s.limiter.Allow()
+}
+
+// perOperationStrategy is the JSON representation of a single strategy
+// returned by the agent (or a configured URL) for a given service/operation.
+type perOperationStrategy struct {
+	Service       string `json:"service"`
+	Operation     string `json:"operation"`
+	Probabilistic struct {
+		SamplingRate float64 `json:"sampling_rate"`
+	} `json:"probabilistic"`
+	LowerBoundTracesPerSecond float64 `json:"lower_bound_traces_per_second"`
+}
+
+// remoteSamplingResponse is the JSON payload served by the agent (or the
+// configured remote sampling URL).
+type remoteSamplingResponse struct {
+	DefaultSamplingProbability float64                `json:"default_sampling_probability"`
+	PerOperationStrategies     []perOperationStrategy `json:"per_operation_strategies"`
+}
+
+// remoteSampler periodically polls the Datadog agent (or a configured URL)
+// for per-service/per-operation sampling strategies, and applies them
+// dynamically. It replaces the static behavior of rulesSampler when enabled
+// via WithRemoteSampling.
+//
+// remoteSampler is safe for concurrent use. The hot path (apply) loads the
+// current set of strategies without a lock, as it is swapped atomically by
+// the background polling goroutine; a per-operation sampler's rate.Limiter
+// still takes its own internal lock when consulted.
+type remoteSampler struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	// strategies holds a *remoteSamplingStrategies, swapped atomically.
+	strategies atomic.Value
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// remoteSamplingStrategies is the immutable snapshot swapped into
+// remoteSampler.strategies on every successful poll.
+type remoteSamplingStrategies struct {
+	defaultRate float64
+	perOp       map[operationKey]*guaranteedThroughputSampler
+}
+
+// newRemoteSampler returns a remoteSampler that polls url every refresh
+// interval. A refresh below remoteSamplingMinInterval is clamped to it.
+func newRemoteSampler(url string, refresh time.Duration) *remoteSampler {
+	if refresh < remoteSamplingMinInterval {
+		refresh = remoteSamplingMinInterval
+	}
+	rs := &remoteSampler{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	rs.strategies.Store(&remoteSamplingStrategies{defaultRate: 1})
+	go rs.run()
+	return rs
+}
+
+// stopRemoteSampler stops the background polling goroutine and waits for it
+// to return.
+func (rs *remoteSampler) stopRemoteSampler() {
+	close(rs.stop)
+	<-rs.done
+}
+
+// run polls the remote sampling URL on the configured interval until stopped,
+// applying jitter to the interval and an exponential backoff on errors. It
+// polls once immediately, rather than waiting out the first interval, so the
+// seeded defaultRate of 1 (100% sampling; see newRemoteSampler) is in effect
+// for as short a window as possible.
+func (rs *remoteSampler) run() {
+	defer close(rs.done)
+	backoff := rs.refresh
+	poll := true
+	for {
+		if poll {
+			if err := rs.poll(); err != nil {
+				log.Warn("remote sampling: error polling %s: %v", rs.url, err)
+				select {
+				case <-rs.stop:
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > 5*rs.refresh {
+					backoff = 5 * rs.refresh
+				}
+				poll = true
+				continue
+			}
+			backoff = rs.refresh
+		}
+		jitter := time.Duration(rand.Int63n(int64(rs.refresh) / 5))
+		select {
+		case <-rs.stop:
+			return
+		case <-time.After(rs.refresh + jitter):
+		}
+		poll = true
+	}
+}
+
+// poll fetches the current strategies from rs.url and, on success, swaps
+// them into rs.strategies. A non-2xx response is treated as an error rather
+// than decoded, since the agent (or a misconfigured URL) may return an error
+// status with an unrelated body such as "{}", which would otherwise decode
+// into a snapshot with a default rate of 0 and silently drop every trace.
+func (rs *remoteSampler) poll() error {
+	resp, err := rs.client.Get(rs.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, rs.url)
+	}
+	var payload remoteSamplingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return err
+	}
+	perOp := make(map[operationKey]*guaranteedThroughputSampler, len(payload.PerOperationStrategies))
+	for _, st := range payload.PerOperationStrategies {
+		key := operationKey{service: st.Service, operation: st.Operation}
+		perOp[key] = newGuaranteedThroughputSampler(st.Probabilistic.SamplingRate, st.LowerBoundTracesPerSecond)
+	}
+	rs.strategies.Store(&remoteSamplingStrategies{
+		defaultRate: payload.DefaultSamplingProbability,
+		perOp:       perOp,
+	})
+	return nil
+}
+
+// decisionMakerRemoteAdaptive is the _dd.p.dm value recording that a span's
+// sampling decision came from remote adaptive per-operation sampling. It is
+// distinct from "-4", which denotes a manual sampling decision.
+const decisionMakerRemoteAdaptive = "-11"
+
+// apply applies the current remote sampling strategies to span, setting its
+// sampling priority and a tag recording the decision maker. It returns true,
+// as a remoteSampler (once enabled) always makes a decision.
+func (rs *remoteSampler) apply(span *span) bool {
+	strategies := rs.strategies.Load().(*remoteSamplingStrategies)
+	key := operationKey{service: span.Service, operation: span.Name}
+	sampled := false
+	if s, ok := strategies.perOp[key]; ok {
+		sampled = s.sample(span.TraceID)
+	} else {
+		sampled = sampledByRate(span.TraceID, strategies.defaultRate)
+	}
+	if sampled {
+		span.SetTag(ext.SamplingPriority, ext.PriorityAutoKeep)
+	} else {
+		span.SetTag(ext.SamplingPriority, ext.PriorityAutoReject)
+	}
+	// _dd.p.dm records the decision maker so backend analytics can tell
+	// remote, per-operation sampling decisions apart from the other samplers.
+	span.SetTag("_dd.p.dm", decisionMakerRemoteAdaptive)
+	return true
+}
+
+// Strategies returns the currently active remote sampling strategies: the
+// default sampling rate and the per-(service,operation) rates in effect.
+// It reports what the last successful poll installed; the _dd.p.dm tag set
+// by apply carries only the decision-maker value, not these rates.
+func (rs *remoteSampler) Strategies() (defaultRate float64, perOperation map[string]float64) {
+	strategies := rs.strategies.Load().(*remoteSamplingStrategies)
+	perOperation = make(map[string]float64, len(strategies.perOp))
+	for key, s := range strategies.perOp {
+		perOperation[key.service+":"+key.operation] = s.rate
+	}
+	return strategies.defaultRate, perOperation
+}
+
+// WithRemoteSampling enables remote adaptive sampling: the tracer polls url
+// every refresh interval for per-service/per-operation sampling strategies
+// and applies them dynamically, replacing the static rulesSampler behavior.
+func WithRemoteSampling(url string, refresh time.Duration) StartOption {
+	return func(c *config) {
+		c.remoteSamplingURL = url
+		c.remoteSamplingRefresh = refresh
+	}
+}
@@ -0,0 +1,104 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuaranteedThroughputSamplerLowerBound(t *testing.T) {
+	assert := assert.New(t)
+	// a zero probabilistic rate means every sample depends entirely on the
+	// guaranteed-throughput bucket.
+	s := newGuaranteedThroughputSampler(0, 1)
+	assert.True(s.sample(1), "first call should consume the initial burst token")
+	assert.False(s.sample(2), "bucket should be empty on the very next call")
+}
+
+func TestGuaranteedThroughputSamplerProbabilistic(t *testing.T) {
+	assert := assert.New(t)
+	// a rate of 1 always samples, regardless of the lower bound.
+	s := newGuaranteedThroughputSampler(1, 0)
+	for i := uint64(0); i < 100; i++ {
+		assert.True(s.sample(i))
+	}
+}
+
+func TestRemoteSamplerApplyFallsBackToDefaultRate(t *testing.T) {
+	assert := assert.New(t)
+	rs := &remoteSampler{}
+	rs.strategies.Store(&remoteSamplingStrategies{defaultRate: 1})
+
+	span := &span{Service: "unknown-service", Name: "unknown-op", Meta: map[string]string{}, Metrics: map[string]float64{}}
+	assert.True(rs.apply(span))
+	assert.Equal(float64(ext.PriorityAutoKeep), span.Metrics[ext.SamplingPriority])
+	assert.Equal(decisionMakerRemoteAdaptive, span.Meta["_dd.p.dm"])
+}
+
+// TestRemoteSamplerPollRejectsNonSuccessStatus guards against a poll
+// silently dropping all traces: a non-2xx response must not overwrite the
+// strategies with whatever empty/garbage body came along with it.
+func TestRemoteSamplerPollRejectsNonSuccessStatus(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	rs := &remoteSampler{url: srv.URL, client: http.DefaultClient}
+	rs.strategies.Store(&remoteSamplingStrategies{defaultRate: 0.5})
+
+	err := rs.poll()
+	assert.Error(err)
+	defaultRate, _ := rs.Strategies()
+	assert.Equal(0.5, defaultRate, "a failed poll must not clobber the last-known-good strategies")
+}
+
+// TestRemoteSamplerRunPollsImmediately guards against the tracer running
+// with the seeded defaultRate of 1 (100% sampling) for a full refresh
+// interval before its first real poll.
+func TestRemoteSamplerRunPollsImmediately(t *testing.T) {
+	assert := assert.New(t)
+	var polls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&polls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"default_sampling_probability":0.25}`))
+	}))
+	defer srv.Close()
+
+	rs := newRemoteSampler(srv.URL, 0) // clamped up to remoteSamplingMinInterval
+	defer rs.stopRemoteSampler()
+
+	assert.Eventually(func() bool {
+		return atomic.LoadInt32(&polls) >= 1
+	}, time.Second, 10*time.Millisecond, "run must poll once before waiting out the refresh interval")
+
+	defaultRate, _ := rs.Strategies()
+	assert.Equal(0.25, defaultRate)
+}
+
+func TestRemoteSamplerStrategies(t *testing.T) {
+	assert := assert.New(t)
+	rs := &remoteSampler{}
+	rs.strategies.Store(&remoteSamplingStrategies{
+		defaultRate: 0.5,
+		perOp: map[operationKey]*guaranteedThroughputSampler{
+			{service: "foo", operation: "HTTP GET"}: newGuaranteedThroughputSampler(0.1, 1),
+		},
+	})
+	defaultRate, perOp := rs.Strategies()
+	assert.Equal(0.5, defaultRate)
+	assert.Equal(0.1, perOp["foo:HTTP GET"])
+}
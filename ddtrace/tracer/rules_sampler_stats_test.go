@@ -0,0 +1,70 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleStatePerRuleLimiterIndependent(t *testing.T) {
+	assert := assert.New(t)
+	// a capped rule and an unlimited rule must not affect each other.
+	capped := newRuleState(1)
+	unlimited := newRuleState(0)
+
+	assert.True(capped.limiter.Allow())
+	assert.False(capped.limiter.Allow(), "the capped rule's burst is exhausted")
+
+	for i := 0; i < 50; i++ {
+		assert.True(unlimited.limiter == nil || unlimited.limiter.Allow())
+	}
+}
+
+func TestRuleStateAdvanceSeedsEWMAFromFirstTick(t *testing.T) {
+	assert := assert.New(t)
+	st := newRuleState(0)
+
+	atomic.AddUint64(&st.curTotal, 4)
+	atomic.AddUint64(&st.curAllowed, 2)
+	st.advance()
+
+	effective, ewma := st.rates()
+	assert.Equal(0.5, effective)
+	assert.Equal(0.5, ewma, "the first tick should seed the EWMA instead of starting at 0")
+}
+
+func TestRuleStateAdvanceSmoothsSubsequentTicks(t *testing.T) {
+	assert := assert.New(t)
+	st := newRuleState(0)
+
+	atomic.AddUint64(&st.curTotal, 10)
+	atomic.AddUint64(&st.curAllowed, 10)
+	st.advance() // rate 1.0, seeds ewma to 1.0
+
+	atomic.AddUint64(&st.curTotal, 10)
+	// no allowed spans this tick: rate 0.0
+	st.advance()
+
+	effective, ewma := st.rates()
+	assert.Equal(0.0, effective)
+	assert.InDelta(1-ewmaAlpha, ewma, 1e-9, "a single low tick should only partially pull the EWMA down")
+}
+
+func TestRuleStateRatesFallBackToLiveSnapshotBeforeFirstTick(t *testing.T) {
+	assert := assert.New(t)
+	st := newRuleState(0)
+
+	atomic.AddUint64(&st.curTotal, 4)
+	atomic.AddUint64(&st.curAllowed, 1)
+
+	// advance hasn't run yet, but rates() shouldn't report a misleading 0.
+	effective, ewma := st.rates()
+	assert.Equal(0.25, effective)
+	assert.Equal(0.25, ewma)
+}
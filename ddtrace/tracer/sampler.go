@@ -13,10 +13,12 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 
 	"golang.org/x/time/rate"
@@ -156,7 +158,8 @@ func (ps *prioritySampler) apply(spn *span) {
 }
 
 // rulesSampler allows a user-defined list of rules to apply to spans.
-// These rules can match based on the span's Service, Operation or both.
+// These rules can match based on the span's Service, Operation, Resource,
+// tags and metrics, in any combination.
 // When making a sampling decision, the rules are checked in order until
 // a match is found.
 // If a match is found, the rate from that rule is used.
@@ -166,34 +169,220 @@ func (ps *prioritySampler) apply(spn *span) {
 // is passed to the priority sampler.
 //
 // The rate is used to determine if the span should be sampled, but an upper
-// limit can be defined using the DD_TRACE_RATE_LIMIT environment variable.
-// Its value is the number of spans to sample per second.
+// limit can be defined per-rule using SamplingRule.MaxPerSecond (falling back
+// to the DD_TRACE_RATE_LIMIT environment variable when no rule matches).
 // Spans that matched the rules but exceeded the rate limit are not sampled.
 type rulesSampler struct {
-	rules   []SamplingRule
-	rate    float64
-	limiter *rate.Limiter
-
-	// "effective rate" calculations
-	mu           sync.Mutex // guards below fields
-	ts           time.Time  // timestamp, to detect when counters need resetting
-	allowed      int        // number of spans allowed by rate limiter
-	total        int        // number of spans checked by rate limiter
-	previousRate float64    // previous second's rate, averaged with current rate for smoothing
+	rules        []SamplingRule
+	states       []*ruleState // parallel to rules; holds each rule's limiter and counters
+	rate         float64
+	limiter      *rate.Limiter // fallback limiter, used when no rule matched but DD_TRACE_SAMPLE_RATE applies
+	limiterState *ruleState    // counters for the fallback limiter
+
+	// hasTagRules is true when at least one rule matches on tags or metrics,
+	// meaning apply must also be called from span.Finish (see apply).
+	hasTagRules bool
+
+	stop chan struct{} // closed to stop the background stats goroutine
+	done chan struct{} // closed once the background stats goroutine has returned
 }
 
+// defaultStatsWindow is the effective window, in one-second ticks, of the
+// exponential moving average used to produce each rule's smoothed
+// RuleStats.EWMARate (see ewmaAlpha).
+const defaultStatsWindow = 10
+
 // newRulesSampler configures a *rulesSampler instance using rules provided in the tracer's StartOptions.
 // Invalid rules or environment variable values are tolerated, by logging warnings and then ignoring them.
 func newRulesSampler(rules []SamplingRule) *rulesSampler {
 	rate := sampleRate()
-	return &rulesSampler{
-		rules:   appliedSamplingRules(rules),
-		rate:    rate,
-		limiter: newRateLimiter(rate),
-		ts:      time.Now().Truncate(time.Second),
+	applied := appliedSamplingRules(rules)
+	var hasTagRules bool
+	states := make([]*ruleState, len(applied))
+	for i, rule := range applied {
+		if rule.hasTagMatchers() {
+			hasTagRules = true
+		}
+		states[i] = newRuleState(rule.MaxPerSecond)
+	}
+	rs := &rulesSampler{
+		rules:        applied,
+		states:       states,
+		rate:         rate,
+		limiter:      newRateLimiter(rate),
+		limiterState: newRuleState(0),
+		hasTagRules:  hasTagRules,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go rs.runStats()
+	return rs
+}
+
+// stopRulesSampler halts the background stats goroutine. It's primarily
+// useful in tests.
+func (rs *rulesSampler) stopRulesSampler() {
+	close(rs.stop)
+	<-rs.done
+}
+
+// runStats folds every rule's per-second counters into its effective rate
+// and EWMA once per second (see ruleState.advance). No per-second history is
+// kept beyond the last second's rate and the running average. It is the only
+// place that performs this bookkeeping, keeping apply's hot path free of the
+// shared lock the single global counter used to require.
+func (rs *rulesSampler) runStats() {
+	defer close(rs.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+			for _, st := range rs.states {
+				st.advance()
+			}
+			rs.limiterState.advance()
+		}
+	}
+}
+
+// ewmaAlpha is the smoothing factor applied on every tick to produce
+// RuleStats.EWMARate, using the standard alpha = 2/(N+1) relationship
+// between a window size N and an exponential moving average.
+const ewmaAlpha = 2.0 / float64(defaultStatsWindow+1)
+
+// ruleState holds the rate limiter and runtime counters for a single applied
+// SamplingRule (or, for limiterState, for the DD_TRACE_RATE_LIMIT fallback).
+// The counters touched by apply (curAllowed, curTotal, matched, kept,
+// dropped) are plain atomics, updated without taking mu; effectiveRate and
+// ewmaRate are written only by the rulesSampler's background stats goroutine
+// and read under mu, both by apply (for _dd.limit_psr) and by RuleStats.
+type ruleState struct {
+	// The uint64 fields below are mutated with atomic.AddUint64/SwapUint64
+	// and so must come first in the struct: the sync/atomic docs guarantee
+	// 64-bit alignment only for the first word of an allocated struct (or
+	// variable), which matters on 32-bit platforms such as 386 and arm.
+	curAllowed uint64 // atomic: spans allowed by limiter since the last tick
+	curTotal   uint64 // atomic: spans checked by limiter since the last tick
+	matched    uint64 // atomic: spans that matched the rule
+	kept       uint64 // atomic: matched spans that were sampled in
+	dropped    uint64 // atomic: matched spans rejected by the limiter
+
+	limiter *rate.Limiter // nil means unlimited
+
+	mu            sync.Mutex // guards the fields below
+	ticked        bool       // whether advance has run at least once
+	effectiveRate float64    // allowed/total over the last full second
+	ewmaRate      float64    // effectiveRate exponentially smoothed over past ticks
+}
+
+// newRuleState returns a ruleState whose limiter allows maxPerSecond spans
+// per second, or is unlimited when maxPerSecond is zero.
+func newRuleState(maxPerSecond float64) *ruleState {
+	st := &ruleState{}
+	if maxPerSecond > 0 {
+		st.limiter = rate.NewLimiter(rate.Limit(maxPerSecond), int(math.Ceil(maxPerSecond)))
+	}
+	return st
+}
+
+// advance folds the counters accumulated since the previous call into the
+// effective rate and its exponential moving average.
+func (st *ruleState) advance() {
+	allowed := atomic.SwapUint64(&st.curAllowed, 0)
+	total := atomic.SwapUint64(&st.curTotal, 0)
+
+	var rate float64
+	if total > 0 {
+		rate = float64(allowed) / float64(total)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.effectiveRate = rate
+	if !st.ticked {
+		// seed the average with the first observation instead of 0, so it
+		// doesn't take defaultStatsWindow ticks to converge.
+		st.ewmaRate = rate
+		st.ticked = true
+	} else {
+		st.ewmaRate = ewmaAlpha*rate + (1-ewmaAlpha)*st.ewmaRate
 	}
 }
 
+// rates returns the most recently computed effective and smoothed rates. If
+// advance hasn't run yet (the first tick hasn't elapsed since this ruleState
+// was created), it falls back to a live snapshot of the in-flight counters
+// so callers don't observe a misleading 0 for the tracer's first second.
+func (st *ruleState) rates() (effective, ewma float64) {
+	st.mu.Lock()
+	ticked := st.ticked
+	effective, ewma = st.effectiveRate, st.ewmaRate
+	st.mu.Unlock()
+	if ticked {
+		return effective, ewma
+	}
+	allowed := atomic.LoadUint64(&st.curAllowed)
+	total := atomic.LoadUint64(&st.curTotal)
+	if total == 0 {
+		return 0, 0
+	}
+	r := float64(allowed) / float64(total)
+	return r, r
+}
+
+// RuleStats reports the runtime matching and sampling counters for a single
+// SamplingRule, as returned by rulesSampler.RuleStats and tracer.SamplerStats.
+type RuleStats struct {
+	// Rule is the rule these stats apply to.
+	Rule SamplingRule
+	// Matched is the number of spans that matched this rule.
+	Matched uint64
+	// Kept is the number of matched spans that were sampled in.
+	Kept uint64
+	// DroppedByLimiter is the number of matched spans that passed the
+	// probabilistic check but were rejected by the rule's rate limiter.
+	DroppedByLimiter uint64
+	// EffectiveRate is the fraction of checked spans the limiter allowed
+	// during the last full second.
+	EffectiveRate float64
+	// EWMARate is EffectiveRate smoothed with an exponential moving average
+	// over defaultStatsWindow ticks, damping single-second spikes.
+	EWMARate float64
+}
+
+// RuleStats returns a point-in-time snapshot of each rule's matching and
+// sampling counters, in the same order the rules are evaluated in.
+func (rs *rulesSampler) RuleStats() []RuleStats {
+	out := make([]RuleStats, len(rs.rules))
+	for i, rule := range rs.rules {
+		st := rs.states[i]
+		er, ewma := st.rates()
+		out[i] = RuleStats{
+			Rule:             rule,
+			Matched:          atomic.LoadUint64(&st.matched),
+			Kept:             atomic.LoadUint64(&st.kept),
+			DroppedByLimiter: atomic.LoadUint64(&st.dropped),
+			EffectiveRate:    er,
+			EWMARate:         ewma,
+		}
+	}
+	return out
+}
+
+// SamplerStats returns the current per-rule sampling counters for the
+// rules sampler configured on the running tracer. It returns nil if the
+// tracer hasn't been started, or if no sampling rules are configured.
+func SamplerStats() []RuleStats {
+	t, ok := internal.GetGlobalTracer().(*tracer)
+	if !ok || t.rulesSampling == nil || len(t.rulesSampling.rules) == 0 {
+		return nil
+	}
+	return t.rulesSampling.RuleStats()
+}
+
 // appliedSamplingRules validates the user-provided rules and returns an internal representation.
 // If the DD_TRACE_SAMPLING_RULES environment variable is set, then the rules from
 // tracer.WithSamplingRules are ignored.
@@ -202,9 +391,12 @@ func appliedSamplingRules(rules []SamplingRule) []SamplingRule {
 	if rulesFromEnv != "" {
 		rules = rules[:0]
 		jsonRules := []struct {
-			Service   string      `json:"service"`
-			Operation string      `json:"operation"`
-			Rate      json.Number `json:"rate"`
+			Service   string                `json:"service"`
+			Operation string                `json:"operation"`
+			Resource  string                `json:"resource"`
+			Rate      json.Number           `json:"rate"`
+			Tags      map[string]string     `json:"tags"`
+			Metrics   map[string][2]float64 `json:"metrics"`
 		}{}
 		err := json.Unmarshal([]byte(rulesFromEnv), &jsonRules)
 		if err != nil {
@@ -221,14 +413,22 @@ func appliedSamplingRules(rules []SamplingRule) []SamplingRule {
 				log.Warn("error parsing rule: invalid rate: %v", err)
 				continue
 			}
-			switch {
-			case v.Service != "" && v.Operation != "":
-				rules = append(rules, ServiceOperationRule(v.Service, v.Operation, rate))
-			case v.Service != "":
-				rules = append(rules, ServiceRule(v.Service, rate))
-			case v.Operation != "":
-				rules = append(rules, OperationRule(v.Operation, rate))
+			rule := SamplingRule{
+				exactService:   v.Service,
+				exactOperation: v.Operation,
+				exactResource:  v.Resource,
+				Rate:           rate,
+			}
+			if len(v.Tags) > 0 {
+				rule.tags = compileTagMatchers(v.Tags)
+			}
+			for k, r := range v.Metrics {
+				rule.metrics = append(rule.metrics, metricMatcher{Key: k, MinNum: r[0], MaxNum: r[1]})
+			}
+			if v.Service == "" && v.Operation == "" && v.Resource == "" && len(v.Tags) == 0 && len(v.Metrics) == 0 {
+				continue
 			}
+			rules = append(rules, rule)
 		}
 	}
 	validRules := make([]SamplingRule, 0, len(rules))
@@ -287,68 +487,142 @@ func newRateLimiter(r float64) *rate.Limiter {
 // provided span. If the rules don't match, and a default rate hasn't been
 // set using DD_TRACE_SAMPLE_RATE, then it returns false and the span is not
 // modified.
-func (rs *rulesSampler) apply(span *span) bool {
+//
+// Rules that match on tags or metrics (see SamplingRule.hasTagMatchers) can
+// only be evaluated once those values have been set on the span, which may
+// happen after StartSpan returns. When rs.hasTagRules is true, the tracer
+// calls apply twice: once from StartSpan with finished set to false, which
+// skips tag-based rules, and once more from span.Finish with finished set to
+// true, which only considers tag-based rules. Rules that don't reference
+// tags are always evaluated from StartSpan.
+func (rs *rulesSampler) apply(span *span, finished bool) bool {
 	var matched bool
+	var idx int
 	rate := rs.rate
-	for _, rule := range rs.rules {
+	for i, rule := range rs.rules {
+		if rule.hasTagMatchers() != finished {
+			continue
+		}
+		if finished && span.ruleMatched && i >= span.ruleIdx {
+			// A rule at an earlier (or the same) index already matched at
+			// StartSpan. Since rules are "checked in order until a match
+			// is found", that earlier rule would have won regardless of
+			// whether this tag rule could have matched too; preserve list
+			// order by not letting it override a decision it wouldn't
+			// have been reached to make in a single pass.
+			continue
+		}
 		if rule.match(span) {
 			matched = true
+			idx = i
 			rate = rule.Rate
 			break
 		}
 	}
+	if matched {
+		span.ruleMatched = true
+		span.ruleIdx = idx
+	}
+	if finished && !matched {
+		// This is the Finish-time pass, which only evaluates tag-based
+		// rules (see hasTagMatchers above). No tag rule matched, so the
+		// decision already made from StartSpan stands; don't re-sample
+		// using the default rate, or we'd double-count against
+		// limiterState and overwrite that decision.
+		return false
+	}
 	if !matched && rate == 0.0 {
 		// no matching rule or global rate, so we want to fall back
 		// to priority sampling
 		return false
 	}
+	st := rs.limiterState
+	limiter := rs.limiter
+	if matched {
+		st = rs.states[idx]
+		limiter = st.limiter
+		atomic.AddUint64(&st.matched, 1)
+	}
+
 	// rate sample
 	span.SetTag("_dd.rule_psr", rate)
 	if !sampledByRate(span.TraceID, rate) {
 		span.SetTag(ext.SamplingPriority, ext.PriorityAutoReject)
 		return true
 	}
-	// global rate limit and effective rate calculations
-	rs.mu.Lock()
-	defer rs.mu.Unlock()
-	ts := time.Now()
-	if d := ts.Sub(rs.ts).Truncate(time.Second); d >= time.Second {
-		// update "previous rate" and reset
-		if d == time.Second && rs.total > 0 && rs.allowed > 0 {
-			rs.previousRate = float64(rs.allowed) / float64(rs.total)
-		} else {
-			rs.previousRate = 0.0
-		}
-		rs.ts = ts.Truncate(time.Second)
-		rs.allowed = 0
-		rs.total = 0
-	}
-
-	rs.total++
-	if rs.limiter != nil && !rs.limiter.AllowN(ts, 1) {
+	// rate limit using the matched rule's own limiter (or the fallback
+	// limiter when no rule matched), tracked lock-free via atomics; the
+	// background stats goroutine folds these into an effective rate.
+	atomic.AddUint64(&st.curTotal, 1)
+	if limiter != nil && !limiter.Allow() {
+		atomic.AddUint64(&st.dropped, 1)
 		span.SetTag(ext.SamplingPriority, ext.PriorityAutoReject)
 	} else {
-		rs.allowed++
+		atomic.AddUint64(&st.curAllowed, 1)
+		if matched {
+			atomic.AddUint64(&st.kept, 1)
+		}
 		span.SetTag(ext.SamplingPriority, ext.PriorityAutoKeep)
 	}
-	// calculate effective rate, and tag the span
-	er := (rs.previousRate + (float64(rs.allowed) / float64(rs.total))) / 2.0
+	er, _ := st.rates()
 	span.SetTag("_dd.limit_psr", er)
 
 	return true
 }
 
+// tagMatcher matches a span's Meta value for Key against Pattern.
+type tagMatcher struct {
+	Key     string
+	Pattern *regexp.Regexp
+}
+
+// metricMatcher matches a span's Metrics value for Key against the inclusive
+// range [MinNum, MaxNum].
+type metricMatcher struct {
+	Key    string
+	MinNum float64
+	MaxNum float64
+}
+
+// compileTagMatchers compiles a map of tag key to regular expression pattern
+// (as accepted by DD_TRACE_SAMPLING_RULES' "tags" object) into tagMatchers.
+// Invalid patterns are logged and skipped.
+func compileTagMatchers(tags map[string]string) []tagMatcher {
+	matchers := make([]tagMatcher, 0, len(tags))
+	for k, pattern := range tags {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Warn("error parsing rule: invalid pattern for tag %q: %v", k, err)
+			continue
+		}
+		matchers = append(matchers, tagMatcher{Key: k, Pattern: re})
+	}
+	return matchers
+}
+
 // SamplingRule is used for applying sampling rates to spans that match
-// the service name, operation or both.
+// the service name, operation, resource, or tags/metrics.
 // It's recommended to use the helper functions (ServiceRule, OperationRule,
-// ServiceOperationRule) instead of directly creating a SamplingRule.
+// ServiceOperationRule, ResourceRule, TagRule, MatchRule) instead of directly
+// creating a SamplingRule.
 type SamplingRule struct {
 	Service   *regexp.Regexp
 	Operation *regexp.Regexp
+	Resource  *regexp.Regexp
 	Rate      float64
 
+	// MaxPerSecond caps the number of spans per second this rule samples in,
+	// independently of every other rule. Zero (the default) means
+	// unlimited. Spans that matched the rule and passed the probabilistic
+	// check are still dropped once this limit is reached; see RuleStats.
+	MaxPerSecond float64
+
 	exactService   string
 	exactOperation string
+	exactResource  string
+
+	tags    []tagMatcher
+	metrics []metricMatcher
 }
 
 // ServiceRule returns a SamplingRule that applies the provided sampling rate
@@ -386,6 +660,51 @@ func RateRule(rate float64) SamplingRule {
 	}
 }
 
+// ResourceRule returns a SamplingRule that applies the provided sampling rate
+// to spans that match the resource name provided.
+func ResourceRule(resource string, rate float64) SamplingRule {
+	return SamplingRule{
+		exactResource: resource,
+		Rate:          rate,
+	}
+}
+
+// TagRule returns a SamplingRule that applies the provided sampling rate to
+// spans whose tags match all of the given key/pattern pairs. Each pattern is
+// compiled as a regular expression and matched against the span's Meta value
+// for that key, so e.g. TagRule(map[string]string{"http.status_code": "5.."}, 1)
+// matches all 5xx responses.
+func TagRule(tags map[string]string, rate float64) SamplingRule {
+	return SamplingRule{
+		Rate: rate,
+		tags: compileTagMatchers(tags),
+	}
+}
+
+// MatchRule returns a SamplingRule combining service, operation and resource
+// patterns (nil to match any) with tag and metric matchers, using AND
+// semantics across all of them. Metric ranges are inclusive [min, max].
+func MatchRule(service, operation, resource *regexp.Regexp, tags map[string]string, metrics map[string][2]float64, rate float64) SamplingRule {
+	metricMatchers := make([]metricMatcher, 0, len(metrics))
+	for k, r := range metrics {
+		metricMatchers = append(metricMatchers, metricMatcher{Key: k, MinNum: r[0], MaxNum: r[1]})
+	}
+	return SamplingRule{
+		Service:   service,
+		Operation: operation,
+		Resource:  resource,
+		Rate:      rate,
+		tags:      compileTagMatchers(tags),
+		metrics:   metricMatchers,
+	}
+}
+
+// hasTagMatchers reports whether the rule matches on span tags or metrics,
+// which may only be set after StartSpan returns (see rulesSampler.apply).
+func (sr *SamplingRule) hasTagMatchers() bool {
+	return len(sr.tags) > 0 || len(sr.metrics) > 0
+}
+
 // match returns true when the span's details match all the expected values in the rule.
 func (sr *SamplingRule) match(s *span) bool {
 	if sr.Service != nil && !sr.Service.MatchString(s.Service) {
@@ -398,5 +717,22 @@ func (sr *SamplingRule) match(s *span) bool {
 	} else if sr.exactOperation != "" && sr.exactOperation != s.Name {
 		return false
 	}
+	if sr.Resource != nil && !sr.Resource.MatchString(s.Resource) {
+		return false
+	} else if sr.exactResource != "" && sr.exactResource != s.Resource {
+		return false
+	}
+	for _, m := range sr.tags {
+		v, ok := s.Meta[m.Key]
+		if !ok || !m.Pattern.MatchString(v) {
+			return false
+		}
+	}
+	for _, m := range sr.metrics {
+		v, ok := s.Metrics[m.Key]
+		if !ok || v < m.MinNum || v > m.MaxNum {
+			return false
+		}
+	}
 	return true
 }
@@ -0,0 +1,159 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import (
+	"os"
+	"testing"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSpan() *span {
+	return &span{
+		Service:  "my-service",
+		Name:     "http.request",
+		Resource: "GET /users",
+		Meta:     map[string]string{"http.status_code": "503"},
+		Metrics:  map[string]float64{"retry.count": 2},
+	}
+}
+
+func TestSamplingRuleResourceMatch(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestSpan()
+
+	assert.True(ResourceRule("GET /users", 1).match(s))
+	assert.False(ResourceRule("GET /other", 1).match(s))
+}
+
+func TestSamplingRuleTagMatch(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestSpan()
+
+	assert.True(TagRule(map[string]string{"http.status_code": "5.."}, 1).match(s))
+	assert.False(TagRule(map[string]string{"http.status_code": "4.."}, 1).match(s))
+	// a missing tag never matches.
+	assert.False(TagRule(map[string]string{"missing.tag": ".*"}, 1).match(s))
+}
+
+func TestSamplingRuleMetricMatch(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestSpan()
+
+	rule := MatchRule(nil, nil, nil, nil, map[string][2]float64{"retry.count": {1, 5}}, 1)
+	assert.True(rule.match(s))
+
+	rule = MatchRule(nil, nil, nil, nil, map[string][2]float64{"retry.count": {3, 5}}, 1)
+	assert.False(rule.match(s))
+}
+
+func TestSamplingRuleHasTagMatchers(t *testing.T) {
+	assert := assert.New(t)
+	assert.False((&SamplingRule{}).hasTagMatchers())
+	assert.True((&SamplingRule{tags: []tagMatcher{{Key: "k", Pattern: nil}}}).hasTagMatchers())
+	assert.True((&SamplingRule{metrics: []metricMatcher{{Key: "k"}}}).hasTagMatchers())
+}
+
+func TestAppliedSamplingRulesFromEnvTagsAndMetrics(t *testing.T) {
+	assert := assert.New(t)
+	old := os.Getenv("DD_TRACE_SAMPLING_RULES")
+	defer os.Setenv("DD_TRACE_SAMPLING_RULES", old)
+	os.Setenv("DD_TRACE_SAMPLING_RULES", `[{"tags":{"http.status_code":"5.."},"metrics":{"retry.count":[1,5]},"rate":1}]`)
+
+	rules := appliedSamplingRules(nil)
+	assert.Len(rules, 1)
+	assert.True(rules[0].match(newTestSpan()))
+}
+
+// TestRulesSamplerFinishNoMatchDoesNotResample guards against double-sampling
+// a span at Finish: when a DD_TRACE_SAMPLE_RATE-style default rate applies
+// at StartSpan (because no tag rule can be evaluated yet) and no tag rule
+// ends up matching at Finish, the StartSpan decision must stand rather than
+// being re-applied (and double-counted) a second time.
+func TestRulesSamplerFinishNoMatchDoesNotResample(t *testing.T) {
+	assert := assert.New(t)
+	rules := []SamplingRule{TagRule(map[string]string{"http.status_code": "4.."}, 1)}
+	rs := newRulesSampler(rules)
+	defer rs.stopRulesSampler()
+	// a global default rate so the early-out at Finish can't rely on
+	// rate == 0 alone.
+	rs.rate = 0.5
+
+	s := newTestSpan()
+	assert.True(rs.apply(s, false), "the default rate applies at StartSpan since no non-tag rule matched")
+
+	applied := rs.apply(s, true)
+	assert.False(applied, "the 4.. tag rule doesn't match a 503, so Finish must not re-sample")
+
+	stats := rs.RuleStats()
+	assert.Equal(uint64(0), stats[0].Matched, "the tag rule itself never matched")
+}
+
+func TestRulesSamplerFinishMatchSamplesOnce(t *testing.T) {
+	assert := assert.New(t)
+	rules := []SamplingRule{TagRule(map[string]string{"http.status_code": "5.."}, 1)}
+	rs := newRulesSampler(rules)
+	defer rs.stopRulesSampler()
+
+	s := newTestSpan()
+	assert.False(rs.apply(s, false))
+	assert.True(rs.apply(s, true))
+
+	stats := rs.RuleStats()
+	assert.Equal(uint64(1), stats[0].Matched)
+	assert.Equal(uint64(1), stats[0].Kept)
+	assert.Equal(float64(ext.PriorityAutoKeep), s.Metrics[ext.SamplingPriority])
+}
+
+// TestRulesSamplerPreservesOrderAgainstLaterTagRule guards "rules are
+// checked in order until a match is found": a tag rule that comes after a
+// rule that already matched at StartSpan must not be allowed to override
+// that decision at Finish, even though it's only evaluated then.
+func TestRulesSamplerPreservesOrderAgainstLaterTagRule(t *testing.T) {
+	assert := assert.New(t)
+	rules := []SamplingRule{
+		ServiceRule("my-service", 1), // index 0: matches first, drops
+		TagRule(map[string]string{"http.status_code": "5.."}, 0), // index 1: would also match, but comes later
+	}
+	rs := newRulesSampler(rules)
+	defer rs.stopRulesSampler()
+
+	s := newTestSpan()
+	assert.True(rs.apply(s, false), "the service rule at index 0 matches immediately")
+	assert.Equal(float64(ext.PriorityAutoKeep), s.Metrics[ext.SamplingPriority])
+
+	assert.False(rs.apply(s, true), "the later tag rule must not get a second say")
+	assert.Equal(float64(ext.PriorityAutoKeep), s.Metrics[ext.SamplingPriority], "the original decision must stand")
+
+	stats := rs.RuleStats()
+	assert.Equal(uint64(0), stats[1].Matched, "the tag rule was correctly skipped, not just overridden")
+}
+
+// TestRulesSamplerEarlierTagRuleStillWins is the mirror case: a tag rule
+// that precedes the rule that would otherwise have matched must still be
+// allowed to win once its tags are available at Finish.
+func TestRulesSamplerEarlierTagRuleStillWins(t *testing.T) {
+	assert := assert.New(t)
+	rules := []SamplingRule{
+		TagRule(map[string]string{"http.status_code": "5.."}, 1), // index 0
+		ServiceRule("my-service", 0),                              // index 1: would otherwise match and drop
+	}
+	rs := newRulesSampler(rules)
+	defer rs.stopRulesSampler()
+
+	s := newTestSpan()
+	assert.True(rs.apply(s, false), "the service rule at index 1 matches at StartSpan, since tag rules are skipped there")
+	assert.Equal(float64(ext.PriorityAutoReject), s.Metrics[ext.SamplingPriority])
+
+	assert.True(rs.apply(s, true), "the earlier tag rule should still win once tags are available")
+	assert.Equal(float64(ext.PriorityAutoKeep), s.Metrics[ext.SamplingPriority])
+
+	stats := rs.RuleStats()
+	assert.Equal(uint64(1), stats[0].Matched)
+}
@@ -0,0 +1,86 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// span represents a computation. Statistics about a span are collected as
+// key/value pairs, stored in Meta (for string values) and Metrics (for
+// numeric values).
+type span struct {
+	sync.Mutex
+
+	Name     string
+	Service  string
+	Resource string
+	TraceID  uint64
+
+	Meta    map[string]string
+	Metrics map[string]float64
+
+	t        *tracer // tracer that created this span, used to finalize sampling at Finish
+	finished bool
+
+	// policyDecided is true once a SamplingPolicy has made a decision for
+	// this span (see tracer.sample). When set, the rules sampler's
+	// Finish-time tag pass must not run, or it would silently override the
+	// policy's decision.
+	policyDecided bool
+
+	// ruleMatched and ruleIdx record which SamplingRule (by index into
+	// rulesSampler.rules) decided this span's sampling at StartSpan, so the
+	// Finish-time tag pass can preserve "rules are checked in order until a
+	// match is found" instead of letting a later tag rule override an
+	// earlier match (see rulesSampler.apply).
+	ruleMatched bool
+	ruleIdx     int
+}
+
+// SetTag sets the given key/value pair on the span. Numeric values are
+// stored in Metrics, everything else in Meta.
+func (s *span) SetTag(key string, value interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	switch v := value.(type) {
+	case string:
+		s.Meta[key] = v
+	case bool:
+		if v {
+			s.Meta[key] = "true"
+		} else {
+			s.Meta[key] = "false"
+		}
+	case float64:
+		s.Metrics[key] = v
+	case int:
+		s.Metrics[key] = float64(v)
+	default:
+		s.Meta[key] = fmt.Sprint(v)
+	}
+}
+
+// Finish closes the span. If the owning tracer's rules sampler has rules
+// that match on tags or metrics, this is where they're finally evaluated,
+// since tag values set after StartSpan are only visible by now (see
+// rulesSampler.apply).
+func (s *span) Finish() {
+	s.Lock()
+	alreadyFinished := s.finished
+	s.finished = true
+	policyDecided := s.policyDecided
+	s.Unlock()
+	if alreadyFinished || s.t == nil || policyDecided {
+		// a SamplingPolicy already made the call for this span at
+		// StartSpan; the rules sampler must not get a second, later say.
+		return
+	}
+	if s.t.remoteSampling == nil && s.t.rulesSampling.hasTagRules {
+		s.t.rulesSampling.apply(s, true)
+	}
+}
@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2019 Datadog, Inc.
+
+package tracer
+
+import "sync"
+
+// tracer creates and submits spans, dispatching each new span to whichever
+// sampling strategy the config selected.
+type tracer struct {
+	config *config
+
+	// rulesSampling applies the static/rules-based sampling chain. It is
+	// always created, even when remoteSampling is enabled, since remote
+	// sampling can be added or removed independently in the future without
+	// another migration of this field.
+	rulesSampling *rulesSampler
+
+	// remoteSampling, when non-nil, replaces rulesSampling's decision for
+	// every span; it's enabled via WithRemoteSampling.
+	remoteSampling *remoteSampler
+
+	stopOnce sync.Once
+}
+
+// newTracer creates a new tracer using the given set of StartOptions.
+func newTracer(opts ...StartOption) *tracer {
+	c := newConfig(opts...)
+	t := &tracer{
+		config:        c,
+		rulesSampling: newRulesSampler(c.samplingRules),
+	}
+	if c.remoteSamplingURL != "" {
+		t.remoteSampling = newRemoteSampler(c.remoteSamplingURL, c.remoteSamplingRefresh)
+	}
+	return t
+}
+
+// StartSpan starts a new span with the given operation name, and runs it
+// through the configured sampling chain.
+func (t *tracer) StartSpan(operationName string) *span {
+	s := &span{
+		Name:    operationName,
+		Service: t.config.serviceName,
+		Meta:    make(map[string]string),
+		Metrics: make(map[string]float64),
+		t:       t,
+	}
+	t.sample(s)
+	return s
+}
+
+// sample applies this tracer's sampling strategies to s, in order of
+// precedence: a user-supplied SamplingPolicy, then remote adaptive sampling
+// when enabled, then the rules sampler.
+func (t *tracer) sample(s *span) {
+	params := SamplingParameters{Service: s.Service, Operation: s.Name, Resource: s.Resource}
+	if applySamplingPolicy(t.config.samplingPolicy, s, params) {
+		// record that the policy decided, so Finish's tag-based rules pass
+		// doesn't silently override it (see span.Finish).
+		s.Lock()
+		s.policyDecided = true
+		s.Unlock()
+		return
+	}
+	if t.remoteSampling != nil {
+		t.remoteSampling.apply(s)
+		return
+	}
+	t.rulesSampling.apply(s, false)
+}
+
+// Stop shuts down the tracer and any background goroutines it started.
+func (t *tracer) Stop() {
+	t.stopOnce.Do(func() {
+		t.rulesSampling.stopRulesSampler()
+		if t.remoteSampling != nil {
+			t.remoteSampling.stopRemoteSampler()
+		}
+	})
+}